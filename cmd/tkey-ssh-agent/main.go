@@ -0,0 +1,73 @@
+// Copyright (C) 2022-2024 - Tillitis AB
+// SPDX-License-Identifier: GPL-2.0-only
+
+// Command tkey-ssh-agent serves the ssh-agent protocol on a Unix
+// socket, backed by the RSA key loaded on a TKey. Point SSH_AUTH_SOCK
+// at the socket it listens on to let ssh, git and other OpenSSH
+// tools use the TKey transparently.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/tillitis/tkeyclient"
+	"github.com/tillitis/tkeysign"
+	"github.com/tillitis/tkeysign/sshagent"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func main() {
+	port := flag.String("port", "", "Path to serial port device")
+	sockPath := flag.String("sock", "", "Path to the Unix socket to listen on (default: $SSH_AUTH_SOCK)")
+	flag.Parse()
+
+	if *sockPath == "" {
+		*sockPath = os.Getenv("SSH_AUTH_SOCK")
+	}
+	if *sockPath == "" {
+		fmt.Fprintln(os.Stderr, "tkey-ssh-agent: no -sock given and SSH_AUTH_SOCK is not set")
+		os.Exit(1)
+	}
+
+	tk := tkeyclient.New()
+	if err := tk.Connect(*port); err != nil {
+		fmt.Fprintf(os.Stderr, "tkey-ssh-agent: Connect: %s\n", err)
+		os.Exit(1)
+	}
+	defer tk.Close()
+
+	signer := tkeysign.New(tk)
+	ag := sshagent.New(&signer)
+
+	if err := os.RemoveAll(*sockPath); err != nil {
+		fmt.Fprintf(os.Stderr, "tkey-ssh-agent: RemoveAll: %s\n", err)
+		os.Exit(1)
+	}
+
+	listener, err := net.Listen("unix", *sockPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tkey-ssh-agent: Listen: %s\n", err)
+		os.Exit(1)
+	}
+	defer listener.Close()
+
+	fmt.Printf("tkey-ssh-agent: listening on %s\n", *sockPath)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "tkey-ssh-agent: Accept: %s\n", err)
+			continue
+		}
+
+		go func() {
+			defer conn.Close()
+			if err := agent.ServeAgent(ag, conn); err != nil {
+				fmt.Fprintf(os.Stderr, "tkey-ssh-agent: ServeAgent: %s\n", err)
+			}
+		}()
+	}
+}
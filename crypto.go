@@ -0,0 +1,93 @@
+// Copyright (C) 2022-2024 - Tillitis AB
+// SPDX-License-Identifier: GPL-2.0-only
+
+package tkeysign
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+// publicExponent is the fixed RSA public exponent used by the
+// signer app. The device only ever hands back the modulus from
+// GetPubkey, so the exponent is assumed fixed, as is common for
+// embedded RSA implementations.
+const publicExponent = 65537
+
+// GetRSAPublicKey fetches the public key of the signer and parses
+// it into an *rsa.PublicKey. The device returns the raw modulus as
+// 256 bytes; the public exponent is fixed at 65537.
+func (s Signer) GetRSAPublicKey() (*rsa.PublicKey, error) {
+	raw, err := s.GetPubkey()
+	if err != nil {
+		return nil, fmt.Errorf("GetPubkey: %w", err)
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(raw),
+		E: publicExponent,
+	}, nil
+}
+
+// Public returns the public key of the signer, implementing part of
+// crypto.Signer. It fetches the key from the device on every call,
+// like the rest of Signer's methods.
+func (s Signer) Public() crypto.PublicKey {
+	pub, err := s.GetRSAPublicKey()
+	if err != nil {
+		return nil
+	}
+
+	return pub
+}
+
+// Sign signs digest with the TKey's RSA key, implementing
+// crypto.Signer. digest must be the result of hashing the message
+// with the hash function indicated by opts; Sign prepends the
+// DigestInfo prefix for PKCS#1 v1.5 signatures before handing the
+// bytes to the device, which performs the raw RSA operation.
+//
+// PSS signatures are not supported, since the device does not
+// expose the padding parameters needed to perform them.
+func (s Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if _, ok := opts.(*rsa.PSSOptions); ok {
+		return nil, fmt.Errorf("tkeysign: PSS signatures are not supported")
+	}
+
+	hash := opts.HashFunc()
+	if hash == crypto.Hash(0) {
+		return nil, fmt.Errorf("tkeysign: unhashed signing is not supported")
+	}
+
+	prefix, ok := hashPrefixes[hash]
+	if !ok {
+		return nil, fmt.Errorf("tkeysign: unsupported hash function %v", hash)
+	}
+	if len(digest) != hash.Size() {
+		return nil, fmt.Errorf("tkeysign: digest length %d does not match hash function", len(digest))
+	}
+
+	msg := make([]byte, 0, len(prefix)+len(digest))
+	msg = append(msg, prefix...)
+	msg = append(msg, digest...)
+
+	signature, err := s.SignData(msg)
+	if err != nil {
+		return nil, fmt.Errorf("SignData: %w", err)
+	}
+
+	return signature, nil
+}
+
+// hashPrefixes holds the DER-encoded DigestInfo prefixes for the
+// hash functions we support, as used in PKCS#1 v1.5 signatures. See
+// RFC 8017, section 9.2, note 1.
+var hashPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
@@ -0,0 +1,239 @@
+// Copyright (C) 2022-2024 - Tillitis AB
+// SPDX-License-Identifier: GPL-2.0-only
+
+package tkeysign
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ErrInvalidPEM is returned when the input to LoadKeyFromReader or
+// LoadKeyFile is neither a valid PEM-encoded RSA private key nor a
+// TKey-encrypted key blob of the expected size.
+var ErrInvalidPEM = errors.New("tkeysign: invalid PEM key")
+
+// ErrKeyAlreadyEncrypted is returned when DryRun is set and the
+// input is already a TKey-encrypted key blob; there is nothing left
+// to encrypt.
+var ErrKeyAlreadyEncrypted = errors.New("tkeysign: key is already encrypted")
+
+// EncryptKey sends a PEM-encoded RSA private key to the TKey to be
+// encrypted under the TKey's device-unique key, returning the
+// resulting ciphertext. It does not load the key for signing, and
+// never touches the filesystem; use LoadKeyFromReader or
+// LoadKeyFile for that.
+func (s Signer) EncryptKey(pemKey []byte) ([]byte, error) {
+	return s.EncryptKeyContext(context.Background(), pemKey)
+}
+
+// EncryptKeyContext is like EncryptKey, but honors ctx: it won't
+// start a new attempt once ctx is done, and retries transport errors
+// (framing, checksum, timeout) according to s.RetryPolicy. This is
+// the single biggest transfer in the package, sending an entire
+// private key to the device, so it's the one most likely to hit a
+// transient transport error.
+func (s Signer) EncryptKeyContext(ctx context.Context, pemKey []byte) ([]byte, error) {
+	var encrypted []byte
+	err := withRetry(ctx, s.RetryPolicy, func() error {
+		var err error
+		encrypted, err = s.encryptKeyOnce(ctx, pemKey)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("encryptKeyOnce: %w", err)
+	}
+
+	return encrypted, nil
+}
+
+// LoadKeyFromReader reads an RSA private key from r and loads it
+// onto the TKey for signing. The input may be either a PEM-encoded
+// plaintext key, which is encrypted on the device before loading, or
+// a key blob already encrypted by a previous call to EncryptKey,
+// which format is detected by trying pem.Decode rather than relying
+// on exact byte counts.
+//
+// If s.DryRun is set and the input is a plaintext PEM key, the key
+// is encrypted but not loaded; call EncryptKey directly to also get
+// the resulting ciphertext back.
+func (s Signer) LoadKeyFromReader(r io.Reader) error {
+	return s.LoadKeyFromReaderContext(context.Background(), r)
+}
+
+// LoadKeyFromReaderContext is like LoadKeyFromReader, but honors
+// ctx: it won't start a new attempt once ctx is done, and retries
+// transport errors (framing, checksum, timeout) according to
+// s.RetryPolicy.
+func (s Signer) LoadKeyFromReaderContext(ctx context.Context, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("ReadAll: %w", err)
+	}
+
+	_, _, err = s.loadKeyData(ctx, data)
+	return err
+}
+
+// LoadKeyFile is like LoadKeyFromReader, but reads the key from the
+// file at path. If the file holds a plaintext PEM key, the
+// newly-encrypted ciphertext is written back to path, replacing the
+// plaintext: the write goes to a temporary file in the same
+// directory, which is fsynced and then renamed over path, so a crash
+// midway leaves the original file intact. If path already holds an
+// encrypted key blob, or s.DryRun is set, the file is left untouched.
+func (s Signer) LoadKeyFile(path string) error {
+	return s.LoadKeyFileContext(context.Background(), path)
+}
+
+// LoadKeyFileContext is like LoadKeyFile, but honors ctx: it won't
+// start a new attempt once ctx is done, and retries transport errors
+// (framing, checksum, timeout) according to s.RetryPolicy.
+func (s Signer) LoadKeyFileContext(ctx context.Context, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("ReadFile: %w", err)
+	}
+
+	encrypted, needsWrite, err := s.loadKeyData(ctx, data)
+	if err != nil {
+		return fmt.Errorf("loadKeyData: %w", err)
+	}
+
+	if s.DryRun || !needsWrite {
+		return nil
+	}
+
+	if err := atomicWriteFile(path, encrypted); err != nil {
+		return fmt.Errorf("atomicWriteFile: %w", err)
+	}
+
+	return nil
+}
+
+// loadKeyData is the shared core of LoadKeyFromReaderContext and
+// LoadKeyFileContext. It returns the encrypted key (whether freshly
+// encrypted or already so), and whether the caller should persist it
+// (true only when data was a plaintext PEM key that got encrypted).
+func (s Signer) loadKeyData(ctx context.Context, data []byte) (encrypted []byte, needsWrite bool, err error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return s.loadAlreadyEncryptedKey(ctx, data)
+	}
+
+	if err := s.checkRSAKeySize(block); err != nil {
+		return nil, false, err
+	}
+
+	encrypted, err = s.EncryptKeyContext(ctx, data)
+	if err != nil {
+		return nil, false, fmt.Errorf("EncryptKeyContext: %w", err)
+	}
+
+	if s.DryRun {
+		return encrypted, false, nil
+	}
+
+	if err := withRetry(ctx, s.RetryPolicy, s.parseKey); err != nil {
+		return nil, false, fmt.Errorf("parseKey: %w", err)
+	}
+
+	return encrypted, true, nil
+}
+
+// checkRSAKeySize parses block as a private key (PKCS#1 or PKCS#8)
+// and confirms it's an RSA key no larger than s.KeySize() bits,
+// before the raw PEM bytes are shipped off to the device; otherwise
+// a wrong key type or size only surfaces later as an opaque
+// device-side failure.
+func (s Signer) checkRSAKeySize(block *pem.Block) error {
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidPEM, err)
+		}
+		rsaKey, ok := k.(*rsa.PrivateKey)
+		if !ok {
+			return fmt.Errorf("%w: not an RSA key", ErrInvalidPEM)
+		}
+		key = rsaKey
+	}
+
+	if bits := key.N.BitLen(); bits > s.KeySize() {
+		return fmt.Errorf("%w: %d-bit RSA key exceeds the device's %d-bit KeySize", ErrInvalidPEM, bits, s.KeySize())
+	}
+
+	return nil
+}
+
+// loadAlreadyEncryptedKey loads a key blob that's already been
+// through EncryptKey, verifying its length matches what s.KeySize()
+// expects before sending it to the device.
+func (s Signer) loadAlreadyEncryptedKey(ctx context.Context, data []byte) (encrypted []byte, needsWrite bool, err error) {
+	size, err := encryptedKeySize(s.KeySize())
+	if err != nil {
+		return nil, false, fmt.Errorf("encryptedKeySize: %w", err)
+	}
+	if len(data) != size {
+		return nil, false, fmt.Errorf("%w: expected PEM or a %d-byte encrypted key, got %d bytes", ErrInvalidPEM, size, len(data))
+	}
+
+	if s.DryRun {
+		return nil, false, ErrKeyAlreadyEncrypted
+	}
+
+	if err := withRetry(ctx, s.RetryPolicy, func() error { return s.loadEncKey(data) }); err != nil {
+		return nil, false, fmt.Errorf("loadEncKey: %w", err)
+	}
+	if err := withRetry(ctx, s.RetryPolicy, s.decryptKey); err != nil {
+		return nil, false, fmt.Errorf("decryptKey: %w", err)
+	}
+	if err := withRetry(ctx, s.RetryPolicy, s.parseKey); err != nil {
+		return nil, false, fmt.Errorf("parseKey: %w", err)
+	}
+
+	return data, false, nil
+}
+
+// atomicWriteFile writes data to a temporary file alongside path,
+// fsyncs it, and renames it over path, so a crash midway never
+// leaves path holding a partial write.
+func atomicWriteFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("OpenFile: %w", err)
+	}
+
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("Write: %w", err)
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("Sync: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Close: %w", err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Rename: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,294 @@
+// Copyright (C) 2022-2024 - Tillitis AB
+// SPDX-License-Identifier: GPL-2.0-only
+
+package tkeysign
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1" //nolint:gosec // required by the OpenPGP v4 fingerprint algorithm, not used for security here
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math/big"
+	"time"
+)
+
+// OpenPGP packet tags (RFC 4880 section 4.3), and the public-key
+// algorithm, hash algorithm and signature type IDs used here.
+const (
+	pgpTagSignature     = 2
+	pgpTagPublicKey     = 6
+	pgpTagLiteralData   = 11
+	pgpTagUserID        = 13
+	pgpTagOnePassSig    = 4
+	pgpAlgoRSA          = 1
+	pgpHashSHA256       = 8
+	pgpSigTypeBinaryDoc = 0x00
+	pgpSigTypeUIDCert   = 0x13
+)
+
+// ExportOpenPGPPublicKey builds an OpenPGP (RFC 4880) transferable
+// public key consisting of a Public-Key packet, a User ID packet
+// for uid, and a self-signature over the two, all produced from the
+// TKey's RSA key. The result can be imported directly with
+// `gpg --import`.
+func (s Signer) ExportOpenPGPPublicKey(uid string, creationTime time.Time) ([]byte, error) {
+	pub, err := s.GetRSAPublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("GetRSAPublicKey: %w", err)
+	}
+
+	pubKeyBody := pgpPublicKeyBody(pub, creationTime)
+	pubKeyPacket := pgpPacket(pgpTagPublicKey, pubKeyBody)
+
+	keyID, err := pgpKeyID(pubKeyBody)
+	if err != nil {
+		return nil, fmt.Errorf("pgpKeyID: %w", err)
+	}
+
+	uidPacket := pgpPacket(pgpTagUserID, []byte(uid))
+
+	hashed := pgpSubpackets(pgpSubpacketCreationTime(creationTime), pgpSubpacketKeyFlags(0x03))
+	unhashed := pgpSubpackets(pgpSubpacketIssuer(keyID))
+
+	digest := pgpCertDigest(pubKeyBody, uid, pgpSigTypeUIDCert, hashed)
+	sigBytes, err := s.signDigest(crypto.SHA256, digest)
+	if err != nil {
+		return nil, fmt.Errorf("signDigest: %w", err)
+	}
+
+	sigPacket := pgpPacket(pgpTagSignature, pgpSignatureBody(pgpSigTypeUIDCert, hashed, unhashed, digest, sigBytes))
+
+	var out bytes.Buffer
+	out.Write(pubKeyPacket)
+	out.Write(uidPacket)
+	out.Write(sigPacket)
+
+	return out.Bytes(), nil
+}
+
+// SignOpenPGPMessage signs the contents of msg with the TKey's RSA
+// key and returns a binary OpenPGP signed message: a one-pass
+// signature packet, a literal data packet holding msg, and a
+// trailing signature packet. The message is hashed with SHA-256 on
+// the host; only the digest is sent to the device.
+func (s Signer) SignOpenPGPMessage(msg io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(msg)
+	if err != nil {
+		return nil, fmt.Errorf("ReadAll: %w", err)
+	}
+
+	pub, err := s.GetRSAPublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("GetRSAPublicKey: %w", err)
+	}
+
+	pubKeyBody := pgpPublicKeyBody(pub, time.Unix(0, 0))
+	keyID, err := pgpKeyID(pubKeyBody)
+	if err != nil {
+		return nil, fmt.Errorf("pgpKeyID: %w", err)
+	}
+
+	now := time.Now()
+
+	onePass := make([]byte, 0, 13)
+	onePass = append(onePass, 3, pgpSigTypeBinaryDoc, pgpHashSHA256, pgpAlgoRSA)
+	onePass = append(onePass, keyID...)
+	onePass = append(onePass, 1) // "nested" flag: this is the only signature
+
+	literal := make([]byte, 0, len(data)+6)
+	literal = append(literal, 'b', 0) // binary data, no filename
+	literal = append(literal, pgpTime(now)...)
+	literal = append(literal, data...)
+
+	hashed := pgpSubpackets(pgpSubpacketCreationTime(now))
+	unhashed := pgpSubpackets(pgpSubpacketIssuer(keyID))
+
+	digest := pgpDocDigest(data, pgpSigTypeBinaryDoc, hashed)
+	sigBytes, err := s.signDigest(crypto.SHA256, digest)
+	if err != nil {
+		return nil, fmt.Errorf("signDigest: %w", err)
+	}
+
+	sigPacket := pgpPacket(pgpTagSignature, pgpSignatureBody(pgpSigTypeBinaryDoc, hashed, unhashed, digest, sigBytes))
+
+	var out bytes.Buffer
+	out.Write(pgpPacket(pgpTagOnePassSig, onePass))
+	out.Write(pgpPacket(pgpTagLiteralData, literal))
+	out.Write(sigPacket)
+
+	return out.Bytes(), nil
+}
+
+// signDigest prepends the PKCS#1 v1.5 DigestInfo prefix for hash
+// and signs the result on the device, returning the raw RSA
+// signature bytes.
+func (s Signer) signDigest(hash crypto.Hash, digest []byte) ([]byte, error) {
+	prefix, ok := hashPrefixes[hash]
+	if !ok {
+		return nil, fmt.Errorf("tkeysign: unsupported hash function %v", hash)
+	}
+
+	msg := make([]byte, 0, len(prefix)+len(digest))
+	msg = append(msg, prefix...)
+	msg = append(msg, digest...)
+
+	return s.SignData(msg)
+}
+
+// pgpPacket wraps body in an OpenPGP new-format packet header for
+// tag.
+func pgpPacket(tag byte, body []byte) []byte {
+	var out bytes.Buffer
+	out.WriteByte(0xc0 | tag)
+
+	switch {
+	case len(body) < 192:
+		out.WriteByte(byte(len(body)))
+	case len(body) < 8384:
+		l := len(body) - 192
+		out.WriteByte(byte(l>>8) + 192)
+		out.WriteByte(byte(l))
+	default:
+		out.WriteByte(0xff)
+		var lenBuf [4]byte
+		lenBuf[0] = byte(len(body) >> 24)
+		lenBuf[1] = byte(len(body) >> 16)
+		lenBuf[2] = byte(len(body) >> 8)
+		lenBuf[3] = byte(len(body))
+		out.Write(lenBuf[:])
+	}
+
+	out.Write(body)
+	return out.Bytes()
+}
+
+// pgpTime encodes t as a 4-byte big-endian Unix timestamp, as used
+// throughout OpenPGP packet bodies.
+func pgpTime(t time.Time) []byte {
+	u := uint32(t.Unix())
+	return []byte{byte(u >> 24), byte(u >> 16), byte(u >> 8), byte(u)}
+}
+
+// pgpMPI encodes n as an OpenPGP multiprecision integer: a two-byte
+// bit count followed by the minimal big-endian byte representation.
+func pgpMPI(n *big.Int) []byte {
+	bits := n.BitLen()
+	b := n.Bytes()
+	return append([]byte{byte(bits >> 8), byte(bits)}, b...)
+}
+
+// pgpPublicKeyBody builds a version 4 RSA Public-Key packet body.
+func pgpPublicKeyBody(pub *rsa.PublicKey, creationTime time.Time) []byte {
+	var out bytes.Buffer
+	out.WriteByte(4)
+	out.Write(pgpTime(creationTime))
+	out.WriteByte(pgpAlgoRSA)
+	out.Write(pgpMPI(pub.N))
+	out.Write(pgpMPI(big.NewInt(int64(pub.E))))
+	return out.Bytes()
+}
+
+// pgpKeyID computes the low-order 64 bits of the version 4
+// fingerprint of a Public-Key packet body, i.e. its key ID.
+func pgpKeyID(pubKeyBody []byte) ([]byte, error) {
+	h := sha1.New() //nolint:gosec // OpenPGP v4 fingerprints are defined over SHA-1
+	h.Write([]byte{0x99, byte(len(pubKeyBody) >> 8), byte(len(pubKeyBody))})
+	h.Write(pubKeyBody)
+	fingerprint := h.Sum(nil)
+	return fingerprint[len(fingerprint)-8:], nil
+}
+
+// pgpSubpackets concatenates the given encoded subpackets.
+func pgpSubpackets(subs ...[]byte) []byte {
+	var out bytes.Buffer
+	for _, s := range subs {
+		out.Write(s)
+	}
+	return out.Bytes()
+}
+
+// pgpSubpacket encodes a single signature subpacket of the given
+// type.
+func pgpSubpacket(typ byte, body []byte) []byte {
+	length := len(body) + 1 // +1 for the type octet
+	var out bytes.Buffer
+	out.WriteByte(byte(length)) // subpacket bodies here are always short
+	out.WriteByte(typ)
+	out.Write(body)
+	return out.Bytes()
+}
+
+// pgpSubpacketCreationTime builds a signature creation time
+// subpacket (type 2).
+func pgpSubpacketCreationTime(t time.Time) []byte {
+	return pgpSubpacket(2, pgpTime(t))
+}
+
+// pgpSubpacketKeyFlags builds a key flags subpacket (type 27).
+func pgpSubpacketKeyFlags(flags byte) []byte {
+	return pgpSubpacket(27, []byte{flags})
+}
+
+// pgpSubpacketIssuer builds an issuer key ID subpacket (type 16).
+func pgpSubpacketIssuer(keyID []byte) []byte {
+	return pgpSubpacket(16, keyID)
+}
+
+// pgpSignatureBody builds a version 4 Signature packet body around
+// an already-computed raw RSA signature.
+func pgpSignatureBody(sigType byte, hashed, unhashed, digest, sigBytes []byte) []byte {
+	var out bytes.Buffer
+	out.WriteByte(4)
+	out.WriteByte(sigType)
+	out.WriteByte(pgpAlgoRSA)
+	out.WriteByte(pgpHashSHA256)
+	out.WriteByte(byte(len(hashed) >> 8))
+	out.WriteByte(byte(len(hashed)))
+	out.Write(hashed)
+	out.WriteByte(byte(len(unhashed) >> 8))
+	out.WriteByte(byte(len(unhashed)))
+	out.Write(unhashed)
+	out.Write(digest[:2])
+	out.Write(pgpMPI(new(big.Int).SetBytes(sigBytes)))
+	return out.Bytes()
+}
+
+// pgpCertDigest computes the SHA-256 digest hashed over a
+// User ID self-signature (sig type 0x13), per RFC 4880 section
+// 5.2.4.
+func pgpCertDigest(pubKeyBody []byte, uid string, sigType byte, hashed []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x99, byte(len(pubKeyBody) >> 8), byte(len(pubKeyBody))})
+	h.Write(pubKeyBody)
+	uidBytes := []byte(uid)
+	h.Write([]byte{0xb4, byte(len(uidBytes) >> 24), byte(len(uidBytes) >> 16), byte(len(uidBytes) >> 8), byte(len(uidBytes))})
+	h.Write(uidBytes)
+	pgpWriteHashedMaterial(h, sigType, hashed)
+	return h.Sum(nil)
+}
+
+// pgpDocDigest computes the SHA-256 digest hashed over a binary
+// document signature (sig type 0x00), per RFC 4880 section 5.2.4.
+func pgpDocDigest(data []byte, sigType byte, hashed []byte) []byte {
+	h := sha256.New()
+	h.Write(data)
+	pgpWriteHashedMaterial(h, sigType, hashed)
+	return h.Sum(nil)
+}
+
+// pgpWriteHashedMaterial writes the signature's own hashed material
+// (version, sig type, public-key algorithm, hash algorithm, and the
+// hashed subpackets) followed by the version 4 trailer, into h, per
+// RFC 4880 section 5.2.4.
+func pgpWriteHashedMaterial(h io.Writer, sigType byte, hashed []byte) {
+	material := make([]byte, 0, 6+len(hashed))
+	material = append(material, 4, sigType, pgpAlgoRSA, pgpHashSHA256)
+	material = append(material, byte(len(hashed)>>8), byte(len(hashed)))
+	material = append(material, hashed...)
+
+	h.Write(material)
+	h.Write([]byte{4, 0xff, byte(len(material) >> 24), byte(len(material) >> 16), byte(len(material) >> 8), byte(len(material))})
+}
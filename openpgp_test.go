@@ -0,0 +1,272 @@
+// Copyright (C) 2022-2024 - Tillitis AB
+// SPDX-License-Identifier: GPL-2.0-only
+
+package tkeysign
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/tillitis/tkeyclient"
+)
+
+// fakeSigningDevice is a fake Transport that plays the part of
+// the signer app well enough to exercise GetPubkey and SignData
+// end-to-end: it accumulates the bytes sent via cmdSetSize/
+// cmdSignData and, on cmdGetSig, signs them for real with key,
+// exactly as the PKCS#1 v1.5 padding and raw RSA operation the
+// device is documented to perform.
+type fakeSigningDevice struct {
+	key *rsa.PrivateKey
+
+	expectedSize int
+	received     []byte
+	frames       [][]byte
+}
+
+func (d *fakeSigningDevice) Write(frame []byte) error {
+	switch frame[1] {
+	case cmdSetSize.Code():
+		d.expectedSize = int(frame[2]) | int(frame[3])<<8 | int(frame[4])<<16 | int(frame[5])<<24
+		d.received = d.received[:0]
+	case cmdSignData.Code():
+		frameLen := cmdSignData.CmdLen().Bytelen() - 1
+		n := frameLen
+		if remaining := d.expectedSize - len(d.received); remaining < n {
+			n = remaining
+		}
+		if n > 0 {
+			d.received = append(d.received, frame[2:2+n]...)
+		}
+	case cmdGetSig.Code():
+		sig, err := rsa.SignPKCS1v15(rand.Reader, d.key, 0, d.received)
+		if err != nil {
+			return fmt.Errorf("SignPKCS1v15: %w", err)
+		}
+		// GetSig always reads back pubkeySize() bytes, which assumes
+		// a 2048-bit key; pad a smaller test key's signature on the
+		// left the same way a real device's raw modexp output would
+		// fill that width, since SetBytes ignores leading zeros.
+		padded := make([]byte, keySizeDefault/8)
+		copy(padded[len(padded)-len(sig):], sig)
+		d.frames = chunkResponse(rspGetSig, padded)
+	case cmdGetPubkey.Code():
+		modulus := d.key.PublicKey.N.Bytes()
+		padded := make([]byte, keySizeDefault/8)
+		copy(padded[len(padded)-len(modulus):], modulus)
+		d.frames = chunkResponse(rspGetPubkey, padded)
+	}
+
+	return nil
+}
+
+func (d *fakeSigningDevice) ReadFrame(cmd tkeyclient.Cmd, _ int) ([]byte, int, error) {
+	switch cmd.Code() {
+	case rspSetSize.Code(), rspSignData.Code():
+		rx := make([]byte, 3)
+		rx[2] = tkeyclient.StatusOK
+		return rx, len(rx), nil
+	default:
+		if len(d.frames) == 0 {
+			return nil, 0, fmt.Errorf("fakeSigningDevice: no frames queued for %s", cmd)
+		}
+		f := d.frames[0]
+		d.frames = d.frames[1:]
+		return f, len(f), nil
+	}
+}
+
+func (d *fakeSigningDevice) SetReadTimeout(int) error { return nil }
+func (d *fakeSigningDevice) Close() error             { return nil }
+
+// chunkResponse splits payload into the frames readResponseStream
+// expects for rspCmd, mirroring writeRequestStream's frameLen.
+func chunkResponse(rspCmd appCmd, payload []byte) [][]byte {
+	frameLen := rspCmd.CmdLen().Bytelen() - 1
+
+	var frames [][]byte
+	for offset := 0; offset < len(payload); offset += frameLen {
+		n := frameLen
+		if remaining := len(payload) - offset; remaining < n {
+			n = remaining
+		}
+		frame := make([]byte, 2+frameLen)
+		copy(frame[2:2+n], payload[offset:offset+n])
+		frames = append(frames, frame)
+	}
+
+	return frames
+}
+
+// decodePacketHeader parses a single new-format OpenPGP packet at
+// the start of data, as built by pgpPacket, returning its tag, body,
+// and the bytes following it.
+func decodePacketHeader(t *testing.T, data []byte) (tag byte, body, rest []byte) {
+	t.Helper()
+
+	if len(data) < 2 || data[0]&0xc0 != 0xc0 {
+		t.Fatalf("decodePacketHeader: not a new-format packet header")
+	}
+	tag = data[0] &^ 0xc0
+
+	switch l := data[1]; {
+	case l < 192:
+		n := int(l)
+		return tag, data[2 : 2+n], data[2+n:]
+	case l < 224:
+		n := (int(l)-192)<<8 + int(data[2]) + 192
+		return tag, data[3 : 3+n], data[3+n:]
+	default:
+		t.Fatalf("decodePacketHeader: unsupported length encoding %#x", l)
+		return 0, nil, nil
+	}
+}
+
+// decodeSignaturePacketBody parses a version 4 Signature packet
+// body as built by pgpSignatureBody.
+func decodeSignaturePacketBody(t *testing.T, body []byte) (sigType byte, hashed, unhashed, left16, sig []byte) {
+	t.Helper()
+
+	if body[0] != 4 {
+		t.Fatalf("decodeSignaturePacketBody: version = %d, want 4", body[0])
+	}
+	sigType = body[1]
+
+	hashedLen := int(body[4])<<8 | int(body[5])
+	hashed = body[6 : 6+hashedLen]
+	off := 6 + hashedLen
+
+	unhashedLen := int(body[off])<<8 | int(body[off+1])
+	unhashed = body[off+2 : off+2+unhashedLen]
+	off += 2 + unhashedLen
+
+	left16 = body[off : off+2]
+	off += 2
+
+	mpiBits := int(body[off])<<8 | int(body[off+1])
+	off += 2
+	mpiLen := (mpiBits + 7) / 8
+	sig = body[off : off+mpiLen]
+
+	return sigType, hashed, unhashed, left16, sig
+}
+
+// verifyDigest checks that sig is a valid PKCS#1 v1.5 signature by
+// pub over digest, using the same SHA-256 DigestInfo prefix signDigest
+// prepends before handing a digest to the device. sig is left-padded
+// back to the modulus size, since its MPI encoding drops leading zero
+// bytes.
+func verifyDigest(pub *rsa.PublicKey, digest, sig []byte) error {
+	if len(sig) < pub.Size() {
+		sig = append(make([]byte, pub.Size()-len(sig)), sig...)
+	}
+	msg := append(append([]byte{}, hashPrefixes[crypto.SHA256]...), digest...)
+	return rsa.VerifyPKCS1v15(pub, 0, msg, sig)
+}
+
+func TestExportOpenPGPPublicKeySelfSignatureVerifies(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	s := Signer{tk: &fakeSigningDevice{key: key}}
+	creationTime := time.Unix(1700000000, 0)
+	uid := "Test User <test@example.com>"
+
+	out, err := s.ExportOpenPGPPublicKey(uid, creationTime)
+	if err != nil {
+		t.Fatalf("ExportOpenPGPPublicKey: %v", err)
+	}
+
+	pubKeyBody := pgpPublicKeyBody(&key.PublicKey, creationTime)
+	wantPubPacket := pgpPacket(pgpTagPublicKey, pubKeyBody)
+	if !bytes.HasPrefix(out, wantPubPacket) {
+		t.Fatalf("ExportOpenPGPPublicKey: public key packet does not match pgpPublicKeyBody output")
+	}
+	rest := out[len(wantPubPacket):]
+
+	wantUIDPacket := pgpPacket(pgpTagUserID, []byte(uid))
+	if !bytes.HasPrefix(rest, wantUIDPacket) {
+		t.Fatalf("ExportOpenPGPPublicKey: user ID packet does not match")
+	}
+	rest = rest[len(wantUIDPacket):]
+
+	tag, body, rest := decodePacketHeader(t, rest)
+	if tag != pgpTagSignature {
+		t.Fatalf("ExportOpenPGPPublicKey: packet tag = %d, want %d", tag, pgpTagSignature)
+	}
+	if len(rest) != 0 {
+		t.Fatalf("ExportOpenPGPPublicKey: %d trailing bytes after the signature packet", len(rest))
+	}
+
+	sigType, hashed, _, left16, sig := decodeSignaturePacketBody(t, body)
+	if sigType != pgpSigTypeUIDCert {
+		t.Fatalf("ExportOpenPGPPublicKey: signature type = %#x, want %#x", sigType, pgpSigTypeUIDCert)
+	}
+
+	digest := pgpCertDigest(pubKeyBody, uid, pgpSigTypeUIDCert, hashed)
+	if !bytes.Equal(left16, digest[:2]) {
+		t.Fatalf("ExportOpenPGPPublicKey: left 16 bits %x do not match digest %x", left16, digest[:2])
+	}
+	if err := verifyDigest(&key.PublicKey, digest, sig); err != nil {
+		t.Fatalf("ExportOpenPGPPublicKey: self-signature does not verify: %v", err)
+	}
+}
+
+func TestSignOpenPGPMessageVerifies(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	s := Signer{tk: &fakeSigningDevice{key: key}}
+	msg := []byte("hello from a test")
+
+	out, err := s.SignOpenPGPMessage(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatalf("SignOpenPGPMessage: %v", err)
+	}
+
+	tag, onePass, rest := decodePacketHeader(t, out)
+	if tag != pgpTagOnePassSig {
+		t.Fatalf("SignOpenPGPMessage: first packet tag = %d, want %d", tag, pgpTagOnePassSig)
+	}
+	if onePass[1] != pgpSigTypeBinaryDoc {
+		t.Fatalf("SignOpenPGPMessage: one-pass sig type = %#x, want %#x", onePass[1], pgpSigTypeBinaryDoc)
+	}
+
+	tag, literal, rest := decodePacketHeader(t, rest)
+	if tag != pgpTagLiteralData {
+		t.Fatalf("SignOpenPGPMessage: second packet tag = %d, want %d", tag, pgpTagLiteralData)
+	}
+	if !bytes.Equal(literal[6:], msg) {
+		t.Fatalf("SignOpenPGPMessage: literal data = %q, want %q", literal[6:], msg)
+	}
+
+	tag, body, rest := decodePacketHeader(t, rest)
+	if tag != pgpTagSignature {
+		t.Fatalf("SignOpenPGPMessage: third packet tag = %d, want %d", tag, pgpTagSignature)
+	}
+	if len(rest) != 0 {
+		t.Fatalf("SignOpenPGPMessage: %d trailing bytes after the signature packet", len(rest))
+	}
+
+	sigType, hashed, _, left16, sig := decodeSignaturePacketBody(t, body)
+	if sigType != pgpSigTypeBinaryDoc {
+		t.Fatalf("SignOpenPGPMessage: signature type = %#x, want %#x", sigType, pgpSigTypeBinaryDoc)
+	}
+
+	digest := pgpDocDigest(msg, pgpSigTypeBinaryDoc, hashed)
+	if !bytes.Equal(left16, digest[:2]) {
+		t.Fatalf("SignOpenPGPMessage: left 16 bits %x do not match digest %x", left16, digest[:2])
+	}
+	if err := verifyDigest(&key.PublicKey, digest, sig); err != nil {
+		t.Fatalf("SignOpenPGPMessage: signature does not verify: %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright (C) 2022-2024 - Tillitis AB
+// SPDX-License-Identifier: GPL-2.0-only
+
+package tkeysign
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// RetryPolicy controls how Signer's methods (the Context variants,
+// which the non-Context methods call) retry transport-level errors (framing, checksum, timeout). A
+// non-OK status from the device is never retried, since the
+// operation has already taken effect on the TKey and retrying could
+// e.g. sign the same data twice.
+//
+// The zero value disables retries: MaxAttempts of 0 means a single
+// attempt is made.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+
+	// Backoff computes the delay after the given failed attempt
+	// (0-based), which ended with lastErr, before the next one. If
+	// nil, DefaultBackoff is used.
+	Backoff func(attempt int, lastErr error) time.Duration
+}
+
+// DefaultRetryPolicy returns a RetryPolicy with a handful of
+// attempts and a truncated exponential backoff capped at 10s, before
+// DefaultBackoff's jitter of up to that much again is added.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   100 * time.Millisecond,
+		MaxDelay:    10 * time.Second,
+	}
+}
+
+// DefaultBackoff computes a truncated exponential backoff with
+// jitter: min(MaxDelay, BaseDelay<<attempt), plus up to that much
+// jitter again, drawn from crypto/rand.
+func DefaultBackoff(policy RetryPolicy) func(attempt int, lastErr error) time.Duration {
+	return func(attempt int, _ error) time.Duration {
+		delay := policy.BaseDelay << attempt
+		if delay <= 0 || delay > policy.MaxDelay {
+			delay = policy.MaxDelay
+		}
+
+		jitter, err := rand.Int(rand.Reader, big.NewInt(int64(delay)+1))
+		if err != nil {
+			return delay
+		}
+
+		return delay + time.Duration(jitter.Int64())
+	}
+}
+
+// transportError marks an error as coming from the transport layer
+// (framing, checksum, timeout) rather than from the device
+// returning a non-OK status. Only transport errors are safe to
+// retry.
+type transportError struct {
+	err error
+}
+
+func (e *transportError) Error() string { return e.err.Error() }
+func (e *transportError) Unwrap() error { return e.err }
+
+// wrapTransport marks err, if non-nil, as a retryable transport
+// error.
+func wrapTransport(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &transportError{err}
+}
+
+// isTransportError reports whether err (or one it wraps) was marked
+// by wrapTransport.
+func isTransportError(err error) bool {
+	var t *transportError
+	return errors.As(err, &t)
+}
+
+// withRetry runs attempt once, and again up to policy.MaxAttempts
+// times as long as it keeps failing with a transport error and ctx
+// hasn't been cancelled. A non-transport error, or a successful
+// call, returns immediately.
+func withRetry(ctx context.Context, policy *RetryPolicy, attempt func() error) error {
+	if policy == nil {
+		policy = &RetryPolicy{}
+	}
+	backoff := policy.Backoff
+	if backoff == nil {
+		backoff = DefaultBackoff(*policy)
+	}
+
+	var lastErr error
+	for n := 0; n <= policy.MaxAttempts; n++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		lastErr = attempt()
+		if lastErr == nil || !isTransportError(lastErr) {
+			return lastErr
+		}
+
+		if n == policy.MaxAttempts {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff(n, lastErr)):
+		}
+	}
+
+	return fmt.Errorf("giving up after %d attempts: %w", policy.MaxAttempts+1, lastErr)
+}
@@ -0,0 +1,194 @@
+// Copyright (C) 2022-2024 - Tillitis AB
+// SPDX-License-Identifier: GPL-2.0-only
+
+// Package sshagent implements the ssh-agent protocol
+// (golang.org/x/crypto/ssh/agent.Agent) backed by a TKey RSA
+// signer, so the TKey's key can be used transparently by OpenSSH,
+// git-over-ssh, and other clients that speak to an SSH agent. Use
+// it like this:
+//
+//	tk := tkeyclient.New()
+//	err := tk.Connect(port)
+//	signer := tkeysign.New(tk)
+//	ag := sshagent.New(&signer)
+//	err = agent.ServeAgent(ag, conn)
+package sshagent
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+
+	"github.com/tillitis/tkeysign"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// loadKeyExtension is the agent extension type used to provision an
+// encrypted key file onto the TKey through ssh-add.
+const loadKeyExtension = "tkeysign-load-key@tillitis.se"
+
+// Agent implements agent.ExtendedAgent, backed by the TKey's RSA
+// signer app. Only the RSA key loaded on the TKey is ever exposed;
+// Add, Remove, RemoveAll, Lock and Unlock are not meaningful for a
+// hardware-backed single key and return
+// agent.ErrOperationUnsupported.
+type Agent struct {
+	signer *tkeysign.Signer
+}
+
+// New returns an Agent backed by signer.
+func New(signer *tkeysign.Signer) *Agent {
+	return &Agent{signer: signer}
+}
+
+// List returns the TKey's RSA key as the agent's sole identity.
+func (a *Agent) List() ([]*agent.Key, error) {
+	pub, err := a.signer.GetRSAPublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("GetRSAPublicKey: %w", err)
+	}
+
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("NewPublicKey: %w", err)
+	}
+
+	comment := "tkey"
+	if nameVer, err := a.signer.GetAppNameVersion(); err == nil {
+		comment = fmt.Sprintf("tkey %s", nameVer.String())
+	}
+
+	return []*agent.Key{
+		{
+			Format:  sshPub.Type(),
+			Blob:    sshPub.Marshal(),
+			Comment: comment,
+		},
+	}, nil
+}
+
+// Sign signs data with the TKey's RSA key, using the "ssh-rsa"
+// (SHA1) signature format for backwards compatibility. Clients that
+// support RFC 8332's rsa-sha2-256/512 should call SignWithFlags
+// instead.
+func (a *Agent) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
+	return a.SignWithFlags(key, data, 0)
+}
+
+// SignWithFlags signs data with the TKey's RSA key, honoring the
+// SHA256/SHA512 flags defined by the ssh-agent extension for RFC
+// 8332 signatures.
+func (a *Agent) SignWithFlags(key ssh.PublicKey, data []byte, flags agent.SignatureFlags) (*ssh.Signature, error) {
+	pub, err := a.signer.GetRSAPublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("GetRSAPublicKey: %w", err)
+	}
+
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, fmt.Errorf("NewPublicKey: %w", err)
+	}
+	if string(sshPub.Marshal()) != string(key.Marshal()) {
+		return nil, fmt.Errorf("sshagent: unknown key")
+	}
+
+	format := ssh.KeyAlgoRSA
+	hash := crypto.SHA1
+	switch {
+	case flags&agent.SignatureFlagRsaSha512 != 0:
+		format = ssh.KeyAlgoRSASHA512
+		hash = crypto.SHA512
+	case flags&agent.SignatureFlagRsaSha256 != 0:
+		format = ssh.KeyAlgoRSASHA256
+		hash = crypto.SHA256
+	}
+
+	digest, err := hashSum(hash, data)
+	if err != nil {
+		return nil, fmt.Errorf("hashSum: %w", err)
+	}
+
+	// signer.Sign hashes-and-pads like any crypto.Signer: it prepends
+	// the DigestInfo prefix matching hash before handing digest to
+	// the device, which is exactly what each SSH signature format
+	// requires here.
+	sig, err := a.signer.Sign(rand.Reader, digest, hash)
+	if err != nil {
+		return nil, fmt.Errorf("Sign: %w", err)
+	}
+
+	return &ssh.Signature{Format: format, Blob: sig}, nil
+}
+
+// hashSum hashes data with hash, which must be one of the SHA
+// variants used by the ssh-rsa (SHA-1), rsa-sha2-256, and
+// rsa-sha2-512 signature formats.
+func hashSum(hash crypto.Hash, data []byte) ([]byte, error) {
+	switch hash {
+	case crypto.SHA1:
+		sum := sha1.Sum(data)
+		return sum[:], nil
+	case crypto.SHA256:
+		sum := sha256.Sum256(data)
+		return sum[:], nil
+	case crypto.SHA512:
+		sum := sha512.Sum512(data)
+		return sum[:], nil
+	default:
+		return nil, fmt.Errorf("sshagent: unsupported hash function %v", hash)
+	}
+}
+
+// Signers is not supported: it always returns
+// agent.ErrExtensionUnsupported and no ssh.Signer. tkeysign.Signer
+// itself implements crypto.Signer.
+func (a *Agent) Signers() ([]ssh.Signer, error) {
+	return nil, agent.ErrExtensionUnsupported
+}
+
+// Add is unsupported; the TKey's key is provisioned with LoadKeyFile,
+// reachable through the loadKeyExtension Extension message.
+func (a *Agent) Add(_ agent.AddedKey) error {
+	return agent.ErrOperationUnsupported
+}
+
+// Remove is unsupported; a TKey always has exactly zero or one key
+// loaded.
+func (a *Agent) Remove(_ ssh.PublicKey) error {
+	return agent.ErrOperationUnsupported
+}
+
+// RemoveAll is unsupported.
+func (a *Agent) RemoveAll() error {
+	return agent.ErrOperationUnsupported
+}
+
+// Lock is unsupported; the TKey itself is the lock.
+func (a *Agent) Lock(_ []byte) error {
+	return agent.ErrOperationUnsupported
+}
+
+// Unlock is unsupported.
+func (a *Agent) Unlock(_ []byte) error {
+	return agent.ErrOperationUnsupported
+}
+
+// Extension implements the loadKeyExtension message, letting
+// ssh-add provision an encrypted key file onto the TKey without any
+// TKey-specific tooling. contents is the path to the key file to
+// load.
+func (a *Agent) Extension(extensionType string, contents []byte) ([]byte, error) {
+	if extensionType != loadKeyExtension {
+		return nil, agent.ErrExtensionUnsupported
+	}
+
+	if err := a.signer.LoadKeyFile(string(contents)); err != nil {
+		return nil, fmt.Errorf("LoadKeyFile: %w", err)
+	}
+
+	return nil, nil
+}
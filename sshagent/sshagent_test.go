@@ -0,0 +1,174 @@
+// Copyright (C) 2022-2024 - Tillitis AB
+// SPDX-License-Identifier: GPL-2.0-only
+
+package sshagent
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"testing"
+
+	"github.com/tillitis/tkeyclient"
+	"github.com/tillitis/tkeysign"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Wire protocol command codes for the RSA signer app that fakeSigner
+// needs to recognize; see tkeysign's (unexported) appCmd table for
+// the full set.
+const (
+	cmdGetPubkey = 0x01
+	rspGetPubkey = 0x02
+	cmdSetSize   = 0x03
+	rspSetSize   = 0x04
+	cmdSignData  = 0x05
+	rspSignData  = 0x06
+	cmdGetSig    = 0x07
+	rspGetSig    = 0x08
+)
+
+// frameLen is the payload size of every frame above: the signer
+// app's CmdLen128 commands carry 128 bytes including the app header,
+// so 127 bytes of content.
+const frameLen = 127
+
+// pubkeySize is the byte size of a 2048-bit RSA modulus or
+// signature, the only key size tkeysign.Signer currently supports.
+const pubkeySize = 2048 / 8
+
+// fakeSigner is a tkeysign.Transport that signs for real with key,
+// so SignWithFlags can be tested without a TKey.
+type fakeSigner struct {
+	key *rsa.PrivateKey
+
+	expectedSize int
+	received     []byte
+	frames       [][]byte
+}
+
+func (f *fakeSigner) Write(frame []byte) error {
+	switch frame[1] {
+	case cmdSetSize:
+		f.expectedSize = int(frame[2]) | int(frame[3])<<8 | int(frame[4])<<16 | int(frame[5])<<24
+		f.received = f.received[:0]
+	case cmdSignData:
+		n := frameLen
+		if remaining := f.expectedSize - len(f.received); remaining < n {
+			n = remaining
+		}
+		if n > 0 {
+			f.received = append(f.received, frame[2:2+n]...)
+		}
+	case cmdGetSig:
+		sig, err := rsa.SignPKCS1v15(rand.Reader, f.key, 0, f.received)
+		if err != nil {
+			return fmt.Errorf("SignPKCS1v15: %w", err)
+		}
+		f.frames = chunkFrames(leftPad(sig, pubkeySize))
+	case cmdGetPubkey:
+		f.frames = chunkFrames(leftPad(f.key.PublicKey.N.Bytes(), pubkeySize))
+	}
+
+	return nil
+}
+
+func (f *fakeSigner) ReadFrame(cmd tkeyclient.Cmd, _ int) ([]byte, int, error) {
+	switch cmd.Code() {
+	case rspSetSize, rspSignData:
+		rx := make([]byte, 3)
+		rx[2] = tkeyclient.StatusOK
+		return rx, len(rx), nil
+	default:
+		if len(f.frames) == 0 {
+			return nil, 0, fmt.Errorf("fakeSigner: no frames queued for cmd %#x", cmd.Code())
+		}
+		fr := f.frames[0]
+		f.frames = f.frames[1:]
+		return fr, len(fr), nil
+	}
+}
+
+func (f *fakeSigner) SetReadTimeout(int) error { return nil }
+func (f *fakeSigner) Close() error             { return nil }
+
+// leftPad pads b on the left with zero bytes out to pubkeySize,
+// since GetPubkey and GetSig always read back that many bytes; a
+// big.Int built from the padded bytes is unchanged, since leading
+// zero bytes carry no value.
+func leftPad(b []byte, size int) []byte {
+	padded := make([]byte, size)
+	copy(padded[size-len(b):], b)
+	return padded
+}
+
+// chunkFrames splits payload into frameLen-sized response frames.
+func chunkFrames(payload []byte) [][]byte {
+	var frames [][]byte
+	for offset := 0; offset < len(payload); offset += frameLen {
+		n := frameLen
+		if remaining := len(payload) - offset; remaining < n {
+			n = remaining
+		}
+		frame := make([]byte, 2+frameLen)
+		copy(frame[2:2+n], payload[offset:offset+n])
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// TestSignWithFlags signs the same data for each of the SHA1/SHA256/
+// SHA512 signature formats and checks that the resulting blob
+// verifies against the digest and format SignWithFlags is documented
+// to produce. SignWithFlags originally signed the raw, unhashed data
+// instead, which this test would have caught: every format's
+// signature would have failed to verify against the correct digest.
+func TestSignWithFlags(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+
+	signer := tkeysign.NewWithTransport(&fakeSigner{key: key})
+	a := New(&signer)
+
+	sshPub, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("NewPublicKey: %v", err)
+	}
+
+	data := []byte("sign me")
+
+	cases := []struct {
+		name   string
+		flags  agent.SignatureFlags
+		format string
+		hash   crypto.Hash
+	}{
+		{"SHA1", 0, ssh.KeyAlgoRSA, crypto.SHA1},
+		{"SHA256", agent.SignatureFlagRsaSha256, ssh.KeyAlgoRSASHA256, crypto.SHA256},
+		{"SHA512", agent.SignatureFlagRsaSha512, ssh.KeyAlgoRSASHA512, crypto.SHA512},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sig, err := a.SignWithFlags(sshPub, data, c.flags)
+			if err != nil {
+				t.Fatalf("SignWithFlags: %v", err)
+			}
+			if sig.Format != c.format {
+				t.Fatalf("SignWithFlags: format = %q, want %q", sig.Format, c.format)
+			}
+
+			digest, err := hashSum(c.hash, data)
+			if err != nil {
+				t.Fatalf("hashSum: %v", err)
+			}
+			if err := rsa.VerifyPKCS1v15(&key.PublicKey, c.hash, digest, sig.Blob); err != nil {
+				t.Fatalf("SignWithFlags: signature does not verify: %v", err)
+			}
+		})
+	}
+}
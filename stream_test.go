@@ -0,0 +1,128 @@
+// Copyright (C) 2022-2024 - Tillitis AB
+// SPDX-License-Identifier: GPL-2.0-only
+
+package tkeysign
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/tillitis/tkeyclient"
+)
+
+// fakeTransport is a fake Transport that serves canned ReadFrame
+// responses from an in-memory queue and records what Write sends, so
+// multi-frame streaming can be exercised without real hardware.
+type fakeTransport struct {
+	writes    [][]byte
+	responses [][]byte
+}
+
+func (f *fakeTransport) Write(frame []byte) error {
+	f.writes = append(f.writes, append([]byte(nil), frame...))
+	return nil
+}
+
+func (f *fakeTransport) ReadFrame(_ tkeyclient.Cmd, _ int) ([]byte, int, error) {
+	if len(f.responses) == 0 {
+		return nil, 0, fmt.Errorf("fakeTransport: no more responses queued")
+	}
+	rsp := f.responses[0]
+	f.responses = f.responses[1:]
+	return rsp, len(rsp), nil
+}
+
+func (f *fakeTransport) SetReadTimeout(int) error { return nil }
+func (f *fakeTransport) Close() error             { return nil }
+
+// TestReadResponseStreamMultiFrame reconstructs a response spanning
+// several frames, including a short final frame, and checks that
+// every payload byte survives in order. This guards against the
+// off-by-one in frameLen that silently dropped and misaligned bytes
+// across frame boundaries.
+func TestReadResponseStreamMultiFrame(t *testing.T) {
+	rspCmd := rspGetPubkey
+	frameLen := rspCmd.CmdLen().Bytelen() - 1
+	total := frameLen*2 + 3 // two full frames plus a short final one
+
+	want := make([]byte, total)
+	for i := range want {
+		want[i] = byte(i)
+	}
+
+	tk := &fakeTransport{}
+	for offset := 0; offset < total; offset += frameLen {
+		n := frameLen
+		if remaining := total - offset; remaining < n {
+			n = remaining
+		}
+		frame := make([]byte, 2+frameLen)
+		copy(frame[2:2+n], want[offset:offset+n])
+		tk.responses = append(tk.responses, frame)
+	}
+
+	s := Signer{tk: tk}
+	got, err := s.readResponseStream(context.Background(), rspCmd, 2, total)
+	if err != nil {
+		t.Fatalf("readResponseStream: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("readResponseStream: got %v, want %v", got, want)
+	}
+}
+
+// TestReadResponseStreamCancellation checks that readResponseStream
+// stops reading further frames once ctx is done, instead of
+// consuming the whole stream.
+func TestReadResponseStreamCancellation(t *testing.T) {
+	rspCmd := rspGetPubkey
+	frameLen := rspCmd.CmdLen().Bytelen() - 1
+	total := frameLen * 3
+
+	tk := &fakeTransport{}
+	for i := 0; i < 3; i++ {
+		tk.responses = append(tk.responses, make([]byte, 2+frameLen))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	s := Signer{tk: tk}
+	if _, err := s.readResponseStream(ctx, rspCmd, 2, total); err == nil {
+		t.Fatal("readResponseStream: expected an error from a cancelled context")
+	}
+	if len(tk.responses) != 3 {
+		t.Fatalf("readResponseStream: consumed %d frames after cancellation, want 0", 3-len(tk.responses))
+	}
+}
+
+// TestWriteRequestStreamChunking checks that writeRequestStream fills
+// a frame with exactly CmdLen().Bytelen()-1 content bytes per call,
+// matching readResponseStream's frameLen, and reports the OK status
+// it receives back.
+func TestWriteRequestStreamChunking(t *testing.T) {
+	cmd := cmdSignData
+	frameLen := cmd.CmdLen().Bytelen() - 1
+	content := make([]byte, frameLen+10)
+
+	rsp := make([]byte, 3)
+	rsp[2] = tkeyclient.StatusOK
+	tk := &fakeTransport{responses: [][]byte{rsp}}
+
+	s := Signer{tk: tk}
+	n, err := s.writeRequestStream(cmd, rspSignData, 2, content)
+	if err != nil {
+		t.Fatalf("writeRequestStream: %v", err)
+	}
+	if n != frameLen {
+		t.Fatalf("writeRequestStream: consumed %d bytes, want %d", n, frameLen)
+	}
+	if len(tk.writes) != 1 {
+		t.Fatalf("writeRequestStream: wrote %d frames, want 1", len(tk.writes))
+	}
+	if got := tk.writes[0][2 : 2+frameLen]; !bytes.Equal(got, content[:frameLen]) {
+		t.Fatalf("writeRequestStream: frame payload %v, want %v", got, content[:frameLen])
+	}
+}
@@ -15,13 +15,28 @@
 //
 // And like this to sign a message:
 //
-//	signature, err := signer.Sign(message)
+//	signature, err := signer.SignData(message)
+//
+// Signer also implements crypto.Signer, so it can be used directly
+// anywhere a standard library crypto.Signer is expected, e.g. with
+// crypto/tls or crypto/x509.
+//
+// The device only ever applies PKCS#1 v1.5 padding before its raw
+// RSA operation, with no parameter to ask for anything else, so
+// Signer cannot produce RSA-PSS signatures; Sign returns an error
+// for an *rsa.PSSOptions argument rather than silently falling back
+// to PKCS#1 v1.5. That rules out TLS 1.3, whose CertificateVerify
+// requires PSS, and anything else that hard-requires it.
+//
+// Signer only supports 2048-bit RSA keys: see KeySize's doc comment
+// for why. Multi-size support (3072, 4096, ...) is not implemented,
+// only scoped down to buffer-size bookkeeping that a later change can
+// build on.
 package tkeysign
 
 import (
-	"encoding/pem"
+	"context"
 	"fmt"
-	"os"
 
 	"github.com/tillitis/tkeyclient"
 )
@@ -76,8 +91,24 @@ func (c appCmd) String() string {
 	return c.name
 }
 
+// Signer implements crypto.Signer, so it can be used directly
+// anywhere a standard library crypto.Signer is expected (crypto/tls,
+// crypto/x509, and similar). It only ever produces PKCS#1 v1.5
+// signatures, never RSA-PSS: see the package doc comment.
 type Signer struct {
-	tk *tkeyclient.TillitisKey // A connection to a TKey
+	tk Transport // A connection to a TKey
+
+	// RetryPolicy controls retries for the Context variants of
+	// Signer's methods (SignDataContext, GetPubkeyContext,
+	// LoadKeyFileContext, ...), and so also for their non-Context
+	// counterparts, which call them with context.Background(). If
+	// nil, each call makes a single attempt.
+	RetryPolicy *RetryPolicy
+
+	// DryRun, when set, makes EncryptKey's callers (LoadKeyFromReader,
+	// LoadKeyFile) stop after encrypting a key on the device, without
+	// loading it for use or touching the filesystem.
+	DryRun bool
 }
 
 // New allocates a struct for communicating with the RSA signer
@@ -95,6 +126,14 @@ func New(tk *tkeyclient.TillitisKey) Signer {
 	return signer
 }
 
+// NewWithTransport builds a Signer around an arbitrary Transport
+// implementation instead of a real TKey connection. It exists so
+// packages built on top of Signer, such as sshagent, can fake the
+// device in their own tests.
+func NewWithTransport(tk Transport) Signer {
+	return Signer{tk: tk}
+}
+
 // Close closes the connection to the TKey
 func (s Signer) Close() error {
 	if err := s.tk.Close(); err != nil {
@@ -106,6 +145,30 @@ func (s Signer) Close() error {
 // GetAppNameVersion gets the name and version of the running app in
 // the same style as the stick itself.
 func (s Signer) GetAppNameVersion() (*tkeyclient.NameVersion, error) {
+	return s.GetAppNameVersionContext(context.Background())
+}
+
+// GetAppNameVersionContext is like GetAppNameVersion, but honors
+// ctx: it won't start a new attempt once ctx is done, and retries
+// transport errors (framing, checksum, timeout) according to
+// s.RetryPolicy.
+func (s Signer) GetAppNameVersionContext(ctx context.Context) (*tkeyclient.NameVersion, error) {
+	var nameVer *tkeyclient.NameVersion
+	err := withRetry(ctx, s.RetryPolicy, func() error {
+		var err error
+		nameVer, err = s.getAppNameVersionOnce()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return nameVer, nil
+}
+
+// getAppNameVersionOnce makes a single, non-retried attempt at
+// fetching the app's name and version.
+func (s Signer) getAppNameVersionOnce() (*tkeyclient.NameVersion, error) {
 	id := 2
 	tx, err := tkeyclient.NewFrameBuf(cmdGetNameVersion, id)
 	if err != nil {
@@ -114,22 +177,22 @@ func (s Signer) GetAppNameVersion() (*tkeyclient.NameVersion, error) {
 
 	tkeyclient.Dump("GetAppNameVersion tx", tx)
 	if err = s.tk.Write(tx); err != nil {
-		return nil, fmt.Errorf("Write: %w", err)
+		return nil, wrapTransport(fmt.Errorf("Write: %w", err))
 	}
 
 	err = s.tk.SetReadTimeout(2)
 	if err != nil {
-		return nil, fmt.Errorf("SetReadTimeout: %w", err)
+		return nil, wrapTransport(fmt.Errorf("SetReadTimeout: %w", err))
 	}
 
 	rx, _, err := s.tk.ReadFrame(rspGetNameVersion, id)
 	if err != nil {
-		return nil, fmt.Errorf("ReadFrame: %w", err)
+		return nil, wrapTransport(fmt.Errorf("ReadFrame: %w", err))
 	}
 
 	err = s.tk.SetReadTimeout(0)
 	if err != nil {
-		return nil, fmt.Errorf("SetReadTimeout: %w", err)
+		return nil, wrapTransport(fmt.Errorf("SetReadTimeout: %w", err))
 	}
 
 	nameVer := &tkeyclient.NameVersion{}
@@ -140,6 +203,29 @@ func (s Signer) GetAppNameVersion() (*tkeyclient.NameVersion, error) {
 
 // GetPubkey fetches the public key of the signer.
 func (s Signer) GetPubkey() ([]byte, error) {
+	return s.GetPubkeyContext(context.Background())
+}
+
+// GetPubkeyContext is like GetPubkey, but honors ctx: it won't start
+// a new attempt once ctx is done, and retries transport errors
+// (framing, checksum, timeout) according to s.RetryPolicy.
+func (s Signer) GetPubkeyContext(ctx context.Context) ([]byte, error) {
+	var pubkeyRaw []byte
+	err := withRetry(ctx, s.RetryPolicy, func() error {
+		var err error
+		pubkeyRaw, err = s.getPubkeyOnce(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return pubkeyRaw, nil
+}
+
+// getPubkeyOnce makes a single, non-retried attempt at fetching the
+// public key, checking ctx between frames.
+func (s Signer) getPubkeyOnce(ctx context.Context) ([]byte, error) {
 	id := 2
 	tx, err := tkeyclient.NewFrameBuf(cmdGetPubkey, id)
 	if err != nil {
@@ -148,41 +234,50 @@ func (s Signer) GetPubkey() ([]byte, error) {
 
 	tkeyclient.Dump("GetPubkey tx", tx)
 	if err = s.tk.Write(tx); err != nil {
-		return nil, fmt.Errorf("Write: %w", err)
+		return nil, wrapTransport(fmt.Errorf("Write: %w", err))
 	}
 
-	rx, _, err := s.tk.ReadFrame(rspGetPubkey, id)
-	tkeyclient.Dump("GetPubKey rx", rx)
+	pubkeyRaw, err := s.readResponseStream(ctx, rspGetPubkey, id, s.pubkeySize())
 	if err != nil {
-		return nil, fmt.Errorf("ReadFrame: %w", err)
+		return nil, fmt.Errorf("readResponseStream: %w", err)
 	}
 
-	pubkeyRaw := make([]byte, 256)
-	// Skip frame header & app header and get the first 127 bytes
-	copy(pubkeyRaw[0:127], rx[2:])
-
-	rx, _, err = s.tk.ReadFrame(rspGetPubkey, id)
-	tkeyclient.Dump("GetPubKey rx", rx)
-	if err != nil {
-		return nil, fmt.Errorf("ReadFrame: %w", err)
-	}
+	return pubkeyRaw, nil
+}
 
-	// Skip frame header & app header and get the next 127 bytes
-	copy(pubkeyRaw[127:254], rx[2:])
+// SignData signs the message in data and returns an RSA signature.
+// This is the raw device-level signing operation; to satisfy
+// crypto.Signer, use Sign instead, which hashes and pads the
+// message before handing it to SignData.
+func (s Signer) SignData(data []byte) ([]byte, error) {
+	return s.SignDataContext(context.Background(), data)
+}
 
-	rx, _, err = s.tk.ReadFrame(rspGetPubkey, id)
-	tkeyclient.Dump("GetPubKey rx", rx)
+// SignDataContext is like SignData, but honors ctx: it won't start a
+// new attempt once ctx is done, and retries transport errors
+// (framing, checksum, timeout) according to s.RetryPolicy. A non-OK
+// status from the device is never retried, to avoid double-signing.
+func (s Signer) SignDataContext(ctx context.Context, data []byte) ([]byte, error) {
+	var signature []byte
+	err := withRetry(ctx, s.RetryPolicy, func() error {
+		var err error
+		signature, err = s.signDataOnce(ctx, data)
+		return err
+	})
 	if err != nil {
-		return nil, fmt.Errorf("ReadFrame: %w", err)
+		return nil, err
 	}
-	// Skip frame header & app header and get the last 2 bytes
-	copy(pubkeyRaw[254:256], rx[2:2+2])
 
-	return pubkeyRaw, nil
+	return signature, nil
 }
 
-// Sign signs the message in data and returns an RSA signature.
-func (s Signer) Sign(data []byte) ([]byte, error) {
+// signDataOnce makes a single, non-retried attempt at signing data,
+// checking ctx between frames so a cancellation doesn't have to
+// wait for the whole transfer. The app's wire protocol has no
+// reset/cancel command, so cancellation only stops this side from
+// reading further frames; it leaves the device to finish the
+// operation it's already mid-way through.
+func (s Signer) signDataOnce(ctx context.Context, data []byte) ([]byte, error) {
 	err := s.setSize(len(data))
 	if err != nil {
 		return nil, fmt.Errorf("setSize: %w", err)
@@ -190,6 +285,10 @@ func (s Signer) Sign(data []byte) ([]byte, error) {
 
 	var offset int
 	for nsent := 0; offset < len(data); offset += nsent {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
 		nsent, err = s.signLoad(data[offset:])
 		if err != nil {
 			return nil, fmt.Errorf("signLoad: %w", err)
@@ -199,7 +298,7 @@ func (s Signer) Sign(data []byte) ([]byte, error) {
 		return nil, fmt.Errorf("transmitted more than expected")
 	}
 
-	signature, err := s.getSig()
+	signature, err := s.getSig(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("getSig: %w", err)
 	}
@@ -207,7 +306,32 @@ func (s Signer) Sign(data []byte) ([]byte, error) {
 	return signature, nil
 }
 
+// GetIsKeyLoaded reports whether a key is currently loaded on the
+// device.
 func (s Signer) GetIsKeyLoaded() (bool, error) {
+	return s.GetIsKeyLoadedContext(context.Background())
+}
+
+// GetIsKeyLoadedContext is like GetIsKeyLoaded, but honors ctx: it
+// won't start a new attempt once ctx is done, and retries transport
+// errors (framing, checksum, timeout) according to s.RetryPolicy.
+func (s Signer) GetIsKeyLoadedContext(ctx context.Context) (bool, error) {
+	var loaded bool
+	err := withRetry(ctx, s.RetryPolicy, func() error {
+		var err error
+		loaded, err = s.getIsKeyLoadedOnce()
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return loaded, nil
+}
+
+// getIsKeyLoadedOnce makes a single, non-retried attempt at checking
+// whether a key is loaded.
+func (s Signer) getIsKeyLoadedOnce() (bool, error) {
 	id := 2
 	tx, err := tkeyclient.NewFrameBuf(cmdIsKeyLoaded, id)
 	if err != nil {
@@ -216,79 +340,28 @@ func (s Signer) GetIsKeyLoaded() (bool, error) {
 
 	tkeyclient.Dump("cmdIsKeyLoaded tx", tx)
 	if err = s.tk.Write(tx); err != nil {
-		return false, fmt.Errorf("Write: %w", err)
+		return false, wrapTransport(fmt.Errorf("Write: %w", err))
 	}
 	rx, _, err := s.tk.ReadFrame(rspIsKeyLoaded, id)
 	tkeyclient.Dump("SetAppSize rx", rx)
 	if err != nil {
-		return false, fmt.Errorf("ReadFrame: %w", err)
+		return false, wrapTransport(fmt.Errorf("ReadFrame: %w", err))
 	}
 
 	return rx[2] == 1, nil
 }
 
-func (s Signer) LoadKey(rsaKeyPath string) error {
-	f, err := os.Open(rsaKeyPath)
-	if err != nil {
-		return fmt.Errorf("failed to open id_rsa. %s", err.Error())
-	}
-	key := make([]byte, 1676)
-	n1, err := f.Read(key)
-	if n1 < 1675 {
-		return fmt.Errorf("did not read enough. Read: %d", n1)
-	}
-	if err != nil {
-		return fmt.Errorf("failed to read: %w", err)
-	}
-
-	f.Close()
-
-	block, _ := pem.Decode(key)
-	if block != nil {
-		encrypted_key, err := s.encryptKey(key)
-		if err != nil {
-			return fmt.Errorf("failed to encrypt: %w", err)
-		}
-		f, err := os.OpenFile(rsaKeyPath, os.O_RDWR, 0755)
-		if err != nil {
-			return fmt.Errorf("failed to open id_rsa for write. %s", err.Error())
-		}
-		n, err := f.Write([]byte(encrypted_key))
-		if n != len(key) {
-			return fmt.Errorf("did not write enough data: %d", n)
-		}
-		if err != nil {
-			return fmt.Errorf("failed to write: %w", err)
-		}
-		err = s.parseKey()
-		if err != nil {
-			return fmt.Errorf("parseKey: %w", err)
-		}
-	} else {
-		err = s.loadEncKey(key)
-		if err != nil {
-			return fmt.Errorf("failed load keye: %w", err)
-		}
-		err := s.decryptKey()
-		if err != nil {
-			return fmt.Errorf("decryptKey: %w", err)
-		}
-		err = s.parseKey()
-		if err != nil {
-			return fmt.Errorf("parseKey: %w", err)
-		}
-	}
-
-	return nil
-}
-
-func (s Signer) transferKey(data []byte) error {
+func (s Signer) transferKey(ctx context.Context, data []byte) error {
 	err := s.setSize(len(data))
 	if err != nil {
 		return fmt.Errorf("setSize: %w", err)
 	}
 	var offset int
 	for nsent := 0; offset < len(data); offset += nsent {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		nsent, err = s.transferPiece(data[offset:])
 		if err != nil {
 			return fmt.Errorf("keyLoad: %w", err)
@@ -320,15 +393,20 @@ func (s Signer) loadEncKey(data []byte) error {
 	return nil
 }
 
-func (s Signer) encryptKey(data []byte) ([]byte, error) {
-	err := s.transferKey(data)
+// encryptKeyOnce makes a single, non-retried attempt at sending a
+// plaintext key to the device and reading back its encrypted form,
+// checking ctx between frames so a cancellation doesn't have to wait
+// for the whole transfer. As with signDataOnce, cancellation can't
+// abort the device side: the protocol has no reset/cancel command.
+func (s Signer) encryptKeyOnce(ctx context.Context, data []byte) ([]byte, error) {
+	err := s.transferKey(ctx, data)
 	if err != nil {
 		return nil, fmt.Errorf("transferKey: %w", err)
 	}
 
-	encData, err := s.keyEncrypt()
+	encData, err := s.keyEncrypt(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("zv: %w", err)
+		return nil, fmt.Errorf("keyEncrypt: %w", err)
 	}
 	return encData, nil
 }
@@ -341,12 +419,12 @@ func (s Signer) parseKey() error {
 	}
 	tkeyclient.Dump("cmdParseKey tx", tx)
 	if err = s.tk.Write(tx); err != nil {
-		return fmt.Errorf("Write: %w", err)
+		return wrapTransport(fmt.Errorf("Write: %w", err))
 	}
 	rx, _, err := s.tk.ReadFrame(rspParseKey, id)
 	tkeyclient.Dump("rspParseKey rx", rx)
 	if err != nil {
-		return fmt.Errorf("ReadFrame: %w", err)
+		return wrapTransport(fmt.Errorf("ReadFrame: %w", err))
 	}
 	if rx[2] != tkeyclient.StatusOK {
 		return fmt.Errorf("parseKey NOK")
@@ -362,12 +440,12 @@ func (s Signer) decryptKey() error {
 	}
 	tkeyclient.Dump("cmdDecryptKey tx", tx)
 	if err = s.tk.Write(tx); err != nil {
-		return fmt.Errorf("Write: %w", err)
+		return wrapTransport(fmt.Errorf("Write: %w", err))
 	}
 	rx, _, err := s.tk.ReadFrame(rspDecryptKey, id)
 	tkeyclient.Dump("rspDecryptKey rx", rx)
 	if err != nil {
-		return fmt.Errorf("ReadFrame: %w", err)
+		return wrapTransport(fmt.Errorf("ReadFrame: %w", err))
 	}
 	if rx[2] != tkeyclient.StatusOK {
 		return fmt.Errorf("decryptKey NOK")
@@ -390,13 +468,13 @@ func (s Signer) setSize(size int) error {
 	tx[5] = byte(size >> 24)
 	tkeyclient.Dump("SetAppSize tx", tx)
 	if err = s.tk.Write(tx); err != nil {
-		return fmt.Errorf("Write: %w", err)
+		return wrapTransport(fmt.Errorf("Write: %w", err))
 	}
 
 	rx, _, err := s.tk.ReadFrame(rspSetSize, id)
 	tkeyclient.Dump("SetAppSize rx", rx)
 	if err != nil {
-		return fmt.Errorf("ReadFrame: %w", err)
+		return wrapTransport(fmt.Errorf("ReadFrame: %w", err))
 	}
 
 	if rx[2] != tkeyclient.StatusOK {
@@ -409,114 +487,20 @@ func (s Signer) setSize(size int) error {
 // signload loads a chunk of a message to sign and waits for a
 // response from the signer.
 func (s Signer) signLoad(content []byte) (int, error) {
-	id := 2
-	tx, err := tkeyclient.NewFrameBuf(cmdSignData, id)
-	if err != nil {
-		return 0, fmt.Errorf("NewFrameBuf: %w", err)
-	}
-
-	payload := make([]byte, cmdSignData.CmdLen().Bytelen()-1)
-	copied := copy(payload, content)
-
-	// Add padding if not filling the payload buffer.
-	if copied < len(payload) {
-		padding := make([]byte, len(payload)-copied)
-		copy(payload[copied:], padding)
-	}
-
-	copy(tx[2:], payload)
-
-	tkeyclient.Dump("LoadSignData tx", tx)
-	if err = s.tk.Write(tx); err != nil {
-		return 0, fmt.Errorf("Write: %w", err)
-	}
-
-	// Wait for reply
-	rx, _, err := s.tk.ReadFrame(rspSignData, id)
-	if err != nil {
-		return 0, fmt.Errorf("ReadFrame: %w", err)
-	}
-
-	if rx[2] != tkeyclient.StatusOK {
-		return 0, fmt.Errorf("SignData NOK")
-	}
-
-	return copied, nil
+	return s.writeRequestStream(cmdSignData, rspSignData, 2, content)
 }
 
 func (s Signer) transferPiece(content []byte) (int, error) {
-	id := 2
-	tx, err := tkeyclient.NewFrameBuf(cmdLoadKey, id)
-	if err != nil {
-		return 0, fmt.Errorf("NewFrameBuf: %w", err)
-	}
-
-	payload := make([]byte, cmdLoadKey.CmdLen().Bytelen()-1)
-	copied := copy(payload, content)
-
-	// Add padding if not filling the payload buffer.
-	if copied < len(payload) {
-		padding := make([]byte, len(payload)-copied)
-		copy(payload[copied:], padding)
-	}
-
-	copy(tx[2:], payload)
-
-	tkeyclient.Dump("cmdLoadKey tx", tx)
-	if err = s.tk.Write(tx); err != nil {
-		return 0, fmt.Errorf("Write: %w", err)
-	}
-
-	// Wait for reply
-	rx, _, err := s.tk.ReadFrame(rspSignData, id)
-	if err != nil {
-		return 0, fmt.Errorf("ReadFrame: %w", err)
-	}
-
-	if rx[2] != tkeyclient.StatusOK {
-		return 0, fmt.Errorf("SignData NOK")
-	}
-
-	return copied, nil
+	return s.writeRequestStream(cmdLoadKey, rspSignData, 2, content)
 }
 
 func (s Signer) keyEncLoad(content []byte) (int, error) {
-	id := 2
-	tx, err := tkeyclient.NewFrameBuf(cmdLoadEncKey, id)
-	if err != nil {
-		return 0, fmt.Errorf("NewFrameBuf: %w", err)
-	}
-
-	payload := make([]byte, cmdLoadEncKey.CmdLen().Bytelen()-1)
-	copied := copy(payload, content)
-
-	// Add padding if not filling the payload buffer.
-	if copied < len(payload) {
-		padding := make([]byte, len(payload)-copied)
-		copy(payload[copied:], padding)
-	}
-
-	copy(tx[2:], payload)
-
-	tkeyclient.Dump("cmdLoadEncKey tx", tx)
-	if err = s.tk.Write(tx); err != nil {
-		return 0, fmt.Errorf("Write: %w", err)
-	}
-
-	// Wait for reply
-	rx, _, err := s.tk.ReadFrame(rspSignData, id)
-	if err != nil {
-		return 0, fmt.Errorf("ReadFrame: %w", err)
-	}
-
-	if rx[2] != tkeyclient.StatusOK {
-		return 0, fmt.Errorf("SignData NOK")
-	}
-
-	return copied, nil
+	return s.writeRequestStream(cmdLoadEncKey, rspSignData, 2, content)
 }
 
-func (s Signer) keyEncrypt() ([]byte, error) {
+// keyEncrypt asks the device to encrypt the key already transferred
+// by transferKey, checking ctx between frames of the response.
+func (s Signer) keyEncrypt(ctx context.Context) ([]byte, error) {
 	id := 2
 
 	tx, err := tkeyclient.NewFrameBuf(cmdEncryptKey, id)
@@ -526,37 +510,25 @@ func (s Signer) keyEncrypt() ([]byte, error) {
 
 	tkeyclient.Dump("keyEnc tx", tx)
 	if err = s.tk.Write(tx); err != nil {
-		return nil, fmt.Errorf("Write: %w", err)
+		return nil, wrapTransport(fmt.Errorf("Write: %w", err))
 	}
 
-	// Wait for reply
-	rsp := make([]byte, 1676)
-	for i := 0; i < 13; i++ {
-		rx, _, err := s.tk.ReadFrame(rspEncryptKey, id)
-		if err != nil {
-			return nil, fmt.Errorf("ReadFrame i=%d: %w", i, err)
-		}
-		copied := copy(rsp[i*127:i*127+127], rx[2:])
-		if copied != 127 {
-			return nil, fmt.Errorf("ReadFrame copied i=%d: ", i)
-		}
-	}
-	// Read the tail
-	rx, _, err := s.tk.ReadFrame(rspEncryptKey, id)
+	total, err := encryptedKeySize(s.KeySize())
 	if err != nil {
-		return nil, fmt.Errorf("ReadFrame tail: %w", err)
+		return nil, fmt.Errorf("encryptedKeySize: %w", err)
 	}
-	copied := copy(rsp[1651:], rx[2:2+25])
-	if copied != 25 {
-		return nil, fmt.Errorf("ReadFrame copied=%d: ", copied)
+
+	rsp, err := s.readResponseStream(ctx, rspEncryptKey, id, total)
+	if err != nil {
+		return nil, fmt.Errorf("readResponseStream: %w", err)
 	}
 
 	return rsp, nil
 }
 
-// getSig gets the RSA signature from the signer app, if
-// available.
-func (s Signer) getSig() ([]byte, error) {
+// getSig gets the RSA signature from the signer app, if available,
+// checking ctx between frames.
+func (s Signer) getSig(ctx context.Context) ([]byte, error) {
 	id := 2
 	tx, err := tkeyclient.NewFrameBuf(cmdGetSig, id)
 	if err != nil {
@@ -565,38 +537,14 @@ func (s Signer) getSig() ([]byte, error) {
 
 	tkeyclient.Dump("getSig tx", tx)
 	if err = s.tk.Write(tx); err != nil {
-		return nil, fmt.Errorf("Write: %w", err)
+		return nil, wrapTransport(fmt.Errorf("Write: %w", err))
 	}
 
-	rx, _, err := s.tk.ReadFrame(rspGetSig, id)
+	signatureRaw, err := s.readResponseStream(ctx, rspGetSig, id, s.pubkeySize())
 	if err != nil {
-		return nil, fmt.Errorf("ReadFrame: %w", err)
+		return nil, fmt.Errorf("readResponseStream: %w", err)
 	}
 
-	// if rx[2] != tkeyclient.StatusOK {
-	// 	return nil, fmt.Errorf("getSig NOK")
-	// }
-
-	signatureRaw := make([]byte, 256)
-	// Skip frame header & app header and get the first 127 bytes
-	copy(signatureRaw[0:127], rx[2:])
-
-	rx, _, err = s.tk.ReadFrame(rspGetSig, id)
-	tkeyclient.Dump("getSig rx", rx)
-	if err != nil {
-		return nil, fmt.Errorf("ReadFrame: %w", err)
-	}
-	// Skip frame header & app header and get the next 127 bytes
-	copy(signatureRaw[127:254], rx[2:])
-
-	rx, _, err = s.tk.ReadFrame(rspGetSig, id)
-	tkeyclient.Dump("getSig rx", rx)
-	if err != nil {
-		return nil, fmt.Errorf("ReadFrame: %w", err)
-	}
-	// Skip frame header & app header and get the last 2 bytes
-	copy(signatureRaw[254:256], rx[2:2+2])
-
 	return signatureRaw, nil
 }
 
@@ -604,6 +552,29 @@ func (s Signer) getSig() ([]byte, error) {
 //
 // It returns the resulting SHA512 digest or an error.
 func (s Signer) GetFWDigest(len int) ([]byte, error) {
+	return s.GetFWDigestContext(context.Background(), len)
+}
+
+// GetFWDigestContext is like GetFWDigest, but honors ctx: it won't
+// start a new attempt once ctx is done, and retries transport errors
+// (framing, checksum, timeout) according to s.RetryPolicy.
+func (s Signer) GetFWDigestContext(ctx context.Context, len int) ([]byte, error) {
+	var digest []byte
+	err := withRetry(ctx, s.RetryPolicy, func() error {
+		var err error
+		digest, err = s.getFWDigestOnce(len)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return digest, nil
+}
+
+// getFWDigestOnce makes a single, non-retried attempt at hashing len
+// bytes of the firmware.
+func (s Signer) getFWDigestOnce(len int) ([]byte, error) {
 	id := 2
 	tx, err := tkeyclient.NewFrameBuf(cmdGetFirmwareHash, id)
 	if err != nil {
@@ -618,13 +589,13 @@ func (s Signer) GetFWDigest(len int) ([]byte, error) {
 
 	tkeyclient.Dump("GetFirmwareHash tx", tx)
 	if err = s.tk.Write(tx); err != nil {
-		return nil, fmt.Errorf("Write: %w", err)
+		return nil, wrapTransport(fmt.Errorf("Write: %w", err))
 	}
 
 	// Wait for reply
 	rx, _, err := s.tk.ReadFrame(rspGetFirmwareHash, id)
 	if err != nil {
-		return nil, fmt.Errorf("ReadFrame: %w", err)
+		return nil, wrapTransport(fmt.Errorf("ReadFrame: %w", err))
 	}
 
 	tkeyclient.Dump("GetFirmwareHash rx", rx)
@@ -0,0 +1,20 @@
+// Copyright (C) 2022-2024 - Tillitis AB
+// SPDX-License-Identifier: GPL-2.0-only
+
+package tkeysign
+
+import "github.com/tillitis/tkeyclient"
+
+// Transport is the subset of *tkeyclient.TillitisKey that Signer
+// depends on for device I/O. It's exported, and NewWithTransport
+// takes one directly, so packages built on top of Signer (such as
+// sshagent) can substitute a fake device in their own tests, the
+// same way this package's own tests substitute a fake multi-frame
+// transport instead of real hardware; New still takes a concrete
+// *tkeyclient.TillitisKey, which satisfies this interface.
+type Transport interface {
+	Write(frame []byte) error
+	ReadFrame(cmd tkeyclient.Cmd, id int) ([]byte, int, error)
+	SetReadTimeout(seconds int) error
+	Close() error
+}
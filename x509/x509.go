@@ -0,0 +1,47 @@
+// Copyright (C) 2022-2024 - Tillitis AB
+// SPDX-License-Identifier: GPL-2.0-only
+
+// Package x509 provides helpers for issuing X.509 certificate
+// signing requests and certificates using a tkeysign.Signer as the
+// signer, via the standard crypto/x509 package. Use it like this to
+// create a CSR:
+//
+//	tk := tkeyclient.New()
+//	err := tk.Connect(port)
+//	signer := tkeysign.New(tk)
+//	csrDER, err := x509.CreateCertificateRequest(&signer, template)
+package x509
+
+import (
+	"crypto/rand"
+	stdx509 "crypto/x509"
+	"fmt"
+
+	"github.com/tillitis/tkeysign"
+)
+
+// CreateCertificateRequest creates a new certificate request based
+// on template, signed with the given TKey signer, and returns the
+// DER-encoded certificate request.
+func CreateCertificateRequest(signer *tkeysign.Signer, template *stdx509.CertificateRequest) ([]byte, error) {
+	csr, err := stdx509.CreateCertificateRequest(rand.Reader, template, signer)
+	if err != nil {
+		return nil, fmt.Errorf("CreateCertificateRequest: %w", err)
+	}
+
+	return csr, nil
+}
+
+// CreateCertificate creates a new certificate based on template and
+// signed by parent, using the given TKey signer as the issuer's
+// private key. pub is the public key of the certificate being
+// issued, which may or may not belong to the TKey. It returns the
+// DER-encoded certificate.
+func CreateCertificate(signer *tkeysign.Signer, template, parent *stdx509.Certificate, pub any) ([]byte, error) {
+	cert, err := stdx509.CreateCertificate(rand.Reader, template, parent, pub, signer)
+	if err != nil {
+		return nil, fmt.Errorf("CreateCertificate: %w", err)
+	}
+
+	return cert, nil
+}